@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheMeta is the sidecar record kept next to every cached payload. It lets
+// fetchAndCache issue conditional GETs and lets handleRequest honor the
+// upstream's own freshness headers instead of a single hard-coded expiry.
+type CacheMeta struct {
+	ETag           string      `json:"etag,omitempty"`
+	LastModified   string      `json:"last_modified,omitempty"`
+	ContentType    string      `json:"content_type,omitempty"`
+	UpstreamStatus int         `json:"upstream_status"`
+	Headers        http.Header `json:"headers,omitempty"`
+	Size           int64       `json:"size"`
+	SHA256         string      `json:"sha256,omitempty"`
+	FetchedAt      time.Time   `json:"fetched_at"`
+	NoStore        bool        `json:"no_store,omitempty"`
+	NoCache        bool        `json:"no_cache,omitempty"`
+	MaxAge         *int64      `json:"max_age,omitempty"` // seconds, from Cache-Control
+	Expires        *time.Time  `json:"expires,omitempty"` // from the Expires header
+	HitCount       int64       `json:"hit_count,omitempty"`
+}
+
+// metaPath returns the sidecar path for a cached payload, e.g.
+// "./cache/foo.png" -> "./cache/foo.png.meta.json".
+func metaPath(cachedFilePath string) string {
+	return cachedFilePath + ".meta.json"
+}
+
+// loadCacheMeta reads the sidecar for cachedFilePath. A missing sidecar is
+// not an error; callers should treat it the same as "no metadata known".
+func loadCacheMeta(cachedFilePath string) (*CacheMeta, error) {
+	data, err := os.ReadFile(metaPath(cachedFilePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read cache metadata: %w", err)
+	}
+
+	var meta CacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse cache metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// saveCacheMeta writes the sidecar atomically via a temp file + rename in the
+// same directory, so a reader never observes a half-written meta file.
+func saveCacheMeta(cachedFilePath string, meta *CacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache metadata: %w", err)
+	}
+	return atomicWriteFile(metaPath(cachedFilePath), data)
+}
+
+// atomicWriteFile writes data to path by creating a temp file in the same
+// directory and renaming it into place, so no reader ever sees a partial file.
+func atomicWriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename temp file into place: %w", err)
+	}
+	return nil
+}
+
+// newCacheMetaFromResponse builds a CacheMeta from a 200 upstream response.
+func newCacheMetaFromResponse(resp *http.Response, size int64, sha256Hex string) *CacheMeta {
+	meta := &CacheMeta{
+		ETag:           resp.Header.Get("ETag"),
+		LastModified:   resp.Header.Get("Last-Modified"),
+		ContentType:    resp.Header.Get("Content-Type"),
+		UpstreamStatus: resp.StatusCode,
+		Headers:        resp.Header.Clone(),
+		Size:           size,
+		SHA256:         sha256Hex,
+		FetchedAt:      time.Now(),
+	}
+	parseCacheControl(meta, resp.Header.Get("Cache-Control"))
+
+	if exp := resp.Header.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			meta.Expires = &t
+		}
+	}
+	return meta
+}
+
+// parseCacheControl fills in the freshness-related fields of meta from a
+// Cache-Control header value.
+func parseCacheControl(meta *CacheMeta, cacheControl string) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store":
+			meta.NoStore = true
+		case directive == "no-cache":
+			meta.NoCache = true
+		case strings.HasPrefix(directive, "max-age="):
+			if secs, err := strconv.ParseInt(strings.TrimPrefix(directive, "max-age="), 10, 64); err == nil {
+				meta.MaxAge = &secs
+			}
+		}
+	}
+}
+
+// isFresh reports whether meta says the cached payload is still usable
+// without revalidation, given its on-disk modification time.
+func (meta *CacheMeta) isFresh(modTime time.Time) bool {
+	if meta == nil {
+		return false
+	}
+	if meta.NoCache || meta.NoStore {
+		return false
+	}
+	if meta.MaxAge != nil {
+		return time.Since(modTime) < time.Duration(*meta.MaxAge)*time.Second
+	}
+	if meta.Expires != nil {
+		return time.Now().Before(*meta.Expires)
+	}
+	return time.Since(modTime) < cacheExpiry
+}
+
+// applyConditionalHeaders sets If-None-Match/If-Modified-Since on req based
+// on a previously cached meta record, if any.
+func applyConditionalHeaders(req *http.Request, meta *CacheMeta) {
+	if meta == nil {
+		return
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+}
+
+// applyResponseCacheHeaders echoes ETag/Last-Modified back to the client so
+// it can revalidate against the proxy the same way the proxy revalidates
+// against upstream.
+func applyResponseCacheHeaders(w http.ResponseWriter, meta *CacheMeta) {
+	if meta == nil {
+		return
+	}
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		w.Header().Set("Last-Modified", meta.LastModified)
+	}
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	cacheMaxBytes       = flag.Int64("cache-max-bytes", 0, "maximum total size of cached payloads in bytes (0 = unbounded)")
+	cacheMaxEntries     = flag.Int64("cache-max-entries", 0, "maximum number of cached entries (0 = unbounded)")
+	cacheEvictionPolicy = flag.String("cache-eviction-policy", "lru", "eviction policy to use once a cap is reached: lru or lfu")
+	cacheLowWatermark   = flag.Float64("cache-low-watermark", 0.9, "fraction of the cap to trim down to once a cap is exceeded")
+	cacheJanitorPeriod  = flag.Duration("cache-janitor-interval", time.Minute, "how often the background janitor checks whether the cache needs trimming")
+)
+
+// cacheEntry tracks everything CacheStore needs to rank a cached payload for
+// eviction, without having to re-stat or re-read its sidecar each time.
+type cacheEntry struct {
+	size       int64
+	lastAccess time.Time
+	hits       int64
+}
+
+// evictionPolicy ranks entries for eviction: less(a, b) reports whether a
+// should be evicted before b. LRU and LFU are both one-line implementations
+// of this; a size-weighted TinyLFU policy could be added the same way.
+type evictionPolicy interface {
+	less(a, b *cacheEntry) bool
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) less(a, b *cacheEntry) bool { return a.lastAccess.Before(b.lastAccess) }
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) less(a, b *cacheEntry) bool { return a.hits < b.hits }
+
+func newEvictionPolicy(name string) evictionPolicy {
+	switch strings.ToLower(name) {
+	case "lfu":
+		return lfuPolicy{}
+	default:
+		return lruPolicy{}
+	}
+}
+
+// CacheStore tracks the on-disk cache's size and entry count against a
+// configurable cap, and evicts entries via a pluggable policy when the cap is
+// exceeded. It rebuilds its index from disk on startup, since the cache
+// directory is the source of truth across restarts.
+type CacheStore struct {
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry // keyed by cachedFilePath
+	totalBytes int64
+	maxBytes   int64
+	maxEntries int64
+	policy     evictionPolicy
+
+	hits   int64 // atomic
+	misses int64 // atomic
+}
+
+// NewCacheStore builds a CacheStore from the -cache-* flags.
+func NewCacheStore() *CacheStore {
+	return &CacheStore{
+		entries:    make(map[string]*cacheEntry),
+		maxBytes:   *cacheMaxBytes,
+		maxEntries: *cacheMaxEntries,
+		policy:     newEvictionPolicy(*cacheEvictionPolicy),
+	}
+}
+
+// rebuildFromDisk walks cacheDir and reconstructs the in-memory index, so a
+// restart doesn't lose track of what's already cached. Sidecar (.meta.json)
+// files are skipped; only payload files count as entries.
+func (s *CacheStore) rebuildFromDisk() error {
+	err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".meta.json") || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		hits := int64(0)
+		if meta, _ := loadCacheMeta(path); meta != nil {
+			hits = meta.HitCount
+		}
+
+		s.mu.Lock()
+		s.entries[path] = &cacheEntry{size: info.Size(), lastAccess: info.ModTime(), hits: hits}
+		s.totalBytes += info.Size()
+		s.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.publishGauges()
+	s.mu.Unlock()
+	return nil
+}
+
+// recordHit marks cachedFilePath as freshly accessed, bumping its hit
+// counter. Call this whenever a request is served from cache.
+func (s *CacheStore) recordHit(cachedFilePath string) {
+	atomic.AddInt64(&s.hits, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[cachedFilePath]
+	if !ok {
+		return
+	}
+	e.lastAccess = time.Now()
+	e.hits++
+}
+
+// recordMiss increments the miss counter. Call this whenever a request
+// cannot be served from cache and upstream must be consulted.
+func (s *CacheStore) recordMiss() {
+	atomic.AddInt64(&s.misses, 1)
+}
+
+// recordWrite tells the store that cachedFilePath now holds size bytes,
+// whether because it was just written or just revalidated. It should be
+// called after every successful fetchAndCache.
+func (s *CacheStore) recordWrite(cachedFilePath string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[cachedFilePath]; ok {
+		s.totalBytes += size - e.size
+		e.size = size
+		e.lastAccess = time.Now()
+	} else {
+		s.entries[cachedFilePath] = &cacheEntry{size: size, lastAccess: time.Now()}
+		s.totalBytes += size
+	}
+	s.publishGauges()
+}
+
+// remove drops cachedFilePath from the index, e.g. after eviction.
+func (s *CacheStore) remove(cachedFilePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[cachedFilePath]; ok {
+		s.totalBytes -= e.size
+		delete(s.entries, cachedFilePath)
+	}
+	s.publishGauges()
+}
+
+// publishGauges updates the Prometheus size/entry gauges. Callers must
+// already hold s.mu.
+func (s *CacheStore) publishGauges() {
+	metricCacheBytes.Set(float64(s.totalBytes))
+	metricCacheEntries.Set(float64(len(s.entries)))
+}
+
+// Stats returns the counters exposed through the metrics endpoint.
+func (s *CacheStore) Stats() (sizeBytes, entryCount, hits, misses int64) {
+	s.mu.Lock()
+	sizeBytes = s.totalBytes
+	entryCount = int64(len(s.entries))
+	s.mu.Unlock()
+	return sizeBytes, entryCount, atomic.LoadInt64(&s.hits), atomic.LoadInt64(&s.misses)
+}
+
+// overCap reports whether the store currently exceeds its configured caps.
+func (s *CacheStore) overCap() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && s.totalBytes > s.maxBytes {
+		return true
+	}
+	if s.maxEntries > 0 && int64(len(s.entries)) > s.maxEntries {
+		return true
+	}
+	return false
+}
+
+// trim evicts entries, lowest-ranked by the configured policy first, until
+// the store is back under its low watermark.
+func (s *CacheStore) trim() {
+	targetBytes := int64(float64(s.maxBytes) * *cacheLowWatermark)
+	targetEntries := int64(float64(s.maxEntries) * *cacheLowWatermark)
+
+	for {
+		s.mu.Lock()
+		underBytes := s.maxBytes == 0 || s.totalBytes <= targetBytes
+		underEntries := s.maxEntries == 0 || int64(len(s.entries)) <= targetEntries
+		if underBytes && underEntries || len(s.entries) == 0 {
+			s.mu.Unlock()
+			return
+		}
+
+		var victimPath string
+		var victim *cacheEntry
+		for path, e := range s.entries {
+			if victim == nil || s.policy.less(e, victim) {
+				victimPath, victim = path, e
+			}
+		}
+		s.mu.Unlock()
+
+		if victim == nil {
+			return
+		}
+
+		// Evicting a path has to take the same per-path lock that readers and
+		// writers use, or a concurrent request can be served the file (or be
+		// mid-write to it) right as it's unlinked out from under it.
+		lock := cacheLocks.shardFor(victimPath)
+		lock.Lock()
+		if err := os.Remove(victimPath); err != nil && !os.IsNotExist(err) {
+			logger.Printf("failed to evict %s: %v", victimPath, err)
+		}
+		os.Remove(metaPath(victimPath))
+		lock.Unlock()
+
+		s.remove(victimPath)
+		metricEvictionsTotal.Inc()
+		logger.Printf("evicted %s (policy=%s)", victimPath, *cacheEvictionPolicy)
+	}
+}
+
+// runJanitor periodically checks whether the cache is over its cap and, if
+// so, trims it back down to the low watermark. It runs for the lifetime of
+// the process.
+func (s *CacheStore) runJanitor() {
+	if s.maxBytes == 0 && s.maxEntries == 0 {
+		return
+	}
+	ticker := time.NewTicker(*cacheJanitorPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.overCap() {
+			s.trim()
+		}
+	}
+}
+
+// runHitCountFlusher periodically persists every entry's in-memory hit
+// counter into its sidecar. recordHit only bumps the counter in memory, on
+// the hot request path, so without this LFU ranking would always restart
+// from zero on a process restart instead of surviving it as intended. It
+// runs for the lifetime of the process, independent of -cache-max-bytes/
+// -cache-max-entries: the counter is meant to be durable whether or not
+// eviction is even enabled.
+func (s *CacheStore) runHitCountFlusher() {
+	ticker := time.NewTicker(*cacheJanitorPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flushHitCounts()
+	}
+}
+
+// flushHitCounts writes the in-memory hit count of every entry out to its
+// .meta.json sidecar, taking each entry's per-path lock in turn so it can't
+// race a concurrent write or eviction of that same path.
+func (s *CacheStore) flushHitCounts() {
+	s.mu.Lock()
+	hits := make(map[string]int64, len(s.entries))
+	for path, e := range s.entries {
+		hits[path] = e.hits
+	}
+	s.mu.Unlock()
+
+	for path, hitCount := range hits {
+		lock := cacheLocks.shardFor(path)
+		lock.Lock()
+		meta, err := loadCacheMeta(path)
+		if err == nil && meta != nil && meta.HitCount != hitCount {
+			meta.HitCount = hitCount
+			if err := saveCacheMeta(path, meta); err != nil {
+				logger.Printf("failed to persist hit count for %s: %v", path, err)
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+// cacheStore is initialized in main() once the -cache-* flags are parsed.
+var cacheStore *CacheStore
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCacheStoreTrimStopsAtLowWatermark checks that trim() evicts enough
+// entries to get back under the low watermark but not further, per chunk0-4.
+func TestCacheStoreTrimStopsAtLowWatermark(t *testing.T) {
+	dir := t.TempDir()
+	lowWatermark := 0.5
+	origWatermark := cacheLowWatermark
+	cacheLowWatermark = &lowWatermark
+	defer func() { cacheLowWatermark = origWatermark }()
+
+	s := &CacheStore{
+		entries:  make(map[string]*cacheEntry),
+		maxBytes: 1000,
+		policy:   lruPolicy{},
+	}
+
+	now := time.Now()
+	sizes := []int64{400, 300, 200, 100}
+	for i, size := range sizes {
+		path := filepath.Join(dir, fmt.Sprintf("entry-%d", i))
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatalf("failed to write fixture file: %v", err)
+		}
+		// Oldest lastAccess first, so LRU evicts entry-0 then entry-1.
+		s.entries[path] = &cacheEntry{size: size, lastAccess: now.Add(time.Duration(i) * time.Second)}
+		s.totalBytes += size
+	}
+
+	s.trim()
+
+	const target = 500 // maxBytes(1000) * lowWatermark(0.5)
+	if s.totalBytes > target {
+		t.Fatalf("trim left totalBytes at %d, want <= %d", s.totalBytes, target)
+	}
+	if len(s.entries) == 0 {
+		t.Fatalf("trim evicted every entry; expected it to stop once under the low watermark")
+	}
+	if s.totalBytes != 300 || len(s.entries) != 2 {
+		t.Fatalf("trim evicted %d bytes / %d entries from state, want 300 bytes / 2 entries remaining", s.totalBytes, len(s.entries))
+	}
+}
+
+// TestCacheStoreFlushHitCountsPersistsToSidecar checks that flushHitCounts
+// writes the in-memory hit counter out to each entry's .meta.json sidecar,
+// per chunk0-4: without this, HitCount always restarts from zero on a
+// process restart even though rebuildFromDisk reads it back in.
+func TestCacheStoreFlushHitCountsPersistsToSidecar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "entry")
+	if err := os.WriteFile(path, []byte("payload"), 0644); err != nil {
+		t.Fatalf("failed to write fixture file: %v", err)
+	}
+	if err := saveCacheMeta(path, &CacheMeta{Size: 7}); err != nil {
+		t.Fatalf("failed to seed sidecar: %v", err)
+	}
+
+	s := &CacheStore{
+		entries: map[string]*cacheEntry{path: {size: 7, hits: 5}},
+	}
+
+	s.flushHitCounts()
+
+	meta, err := loadCacheMeta(path)
+	if err != nil {
+		t.Fatalf("failed to reload sidecar: %v", err)
+	}
+	if meta.HitCount != 5 {
+		t.Fatalf("sidecar HitCount = %d, want 5", meta.HitCount)
+	}
+}
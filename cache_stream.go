@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var maxInFlightBodyBytes = flag.Int64("max-inflight-body-bytes", 0, "cap on upstream response body size while streaming a cache fill (0 = unbounded)")
+
+// errBodyCapExceeded is returned when an upstream body exceeds
+// -max-inflight-body-bytes.
+var errBodyCapExceeded = errors.New("upstream body exceeded max-inflight-body-bytes cap")
+
+// capWriter enforces maxInFlightBodyBytes on what actually reaches the
+// client: once the limit is hit it stops forwarding immediately and reports
+// errBodyCapExceeded, instead of letting the whole (already over-cap) body
+// reach the client before the cap is even noticed.
+type capWriter struct {
+	io.Writer
+	limit   int64
+	written int64
+}
+
+func (c *capWriter) Write(p []byte) (int, error) {
+	if c.written >= c.limit {
+		return 0, errBodyCapExceeded
+	}
+	allowed := c.limit - c.written
+	if int64(len(p)) <= allowed {
+		n, err := c.Writer.Write(p)
+		c.written += int64(n)
+		return n, err
+	}
+	n, err := c.Writer.Write(p[:allowed])
+	c.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, errBodyCapExceeded
+}
+
+// streamFetchAndCache is the streaming counterpart to fetchAndCache: for a
+// cache miss it writes the upstream response to rw and to the cache
+// simultaneously, instead of downloading the whole body before serving
+// anything. It still shares fetchGroup with the background-refresh path, so
+// a thundering herd of misses still results in one upstream fetch — only the
+// request that actually triggers that fetch streams live; any requests that
+// piggyback on the same in-flight fill get `streamed=false` and should be
+// served from the now-complete cache file by the caller.
+func streamFetchAndCache(rw *statusCountingWriter, r *http.Request, requestedPath, cachedFilePath, upstreamBaseURL string) (result cacheResult, upstreamStatus int, err error, streamed bool) {
+	v, ferr, _ := fetchGroup.Do(cachedFilePath, func() (interface{}, error) {
+		streamed = true
+		res, status, err2 := doStreamFetchAndCache(rw, r, requestedPath, cachedFilePath, upstreamBaseURL)
+		return fetchOutcome{res, status}, err2
+	})
+
+	// The streaming leader (and only the leader: followers' closures above
+	// never ran, so their own rw never received a byte) has already written
+	// a partial, over-cap body straight to its client by the time
+	// errBodyCapExceeded comes back. There's no way to turn that into a
+	// well-formed error response without appending garbage onto an
+	// already-sent 200, so abort the response outright instead - this must
+	// happen here, after fetchGroup.Do has returned, rather than inside the
+	// singleflight closure: singleflight recovers panics from the function it
+	// runs and turns them back into a plain error for the very caller whose
+	// closure panicked, so panicking inside doStreamFetchAndCache would never
+	// reach net/http's own per-request recover that actually severs the
+	// connection (TCP close for HTTP/1.1, RST_STREAM for HTTP/2).
+	if streamed && errors.Is(ferr, errBodyCapExceeded) {
+		panic(http.ErrAbortHandler)
+	}
+
+	outcome := v.(fetchOutcome)
+	return outcome.result, outcome.upstreamStatus, ferr, streamed
+}
+
+func doStreamFetchAndCache(rw *statusCountingWriter, r *http.Request, requestedPath, cachedFilePath, upstreamBaseURL string) (cacheResult, int, error) {
+	remoteURL := upstreamBaseURL + requestedPath
+
+	tlsConf, err := skipVerification()
+	if err != nil {
+		log.Fatalf("Error creating TLS configuration: %v", err)
+	}
+
+	client := &http.Client{
+		Timeout:   time.Second * 50,
+		Transport: &http.Transport{TLSClientConfig: tlsConf},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	lock := cacheLocks.shardFor(cachedFilePath)
+
+	lock.RLock()
+	existingMeta, _ := loadCacheMeta(cachedFilePath)
+	lock.RUnlock()
+	applyConditionalHeaders(req, existingMeta)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch from remote: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		lock.Lock()
+		if existingMeta == nil {
+			lock.Unlock()
+			return "", resp.StatusCode, fmt.Errorf("remote returned 304 but no cached metadata exists for %s", requestedPath)
+		}
+		existingMeta.FetchedAt = time.Now()
+		if err := saveCacheMeta(cachedFilePath, existingMeta); err != nil {
+			lock.Unlock()
+			return "", resp.StatusCode, err
+		}
+		now := time.Now()
+		if err := os.Chtimes(cachedFilePath, now, now); err != nil {
+			lock.Unlock()
+			return "", resp.StatusCode, err
+		}
+		cacheStore.recordWrite(cachedFilePath, existingMeta.Size)
+
+		// Keep the lock held through the serve itself, not just the metadata
+		// update above - otherwise trim() can unlink the payload in the
+		// window between releasing the lock and ServeFile opening it.
+		applyResponseCacheHeaders(rw, existingMeta)
+		http.ServeFile(rw, r, cachedFilePath)
+		lock.Unlock()
+		return cacheRefresh, resp.StatusCode, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, fmt.Errorf("remote server returned non-200 status code: %d", resp.StatusCode)
+	}
+
+	dir := filepath.Dir(cachedFilePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to create cache directories: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(cachedFilePath)+".tmp-*")
+	if err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		rw.Header().Set("Content-Type", ct)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		rw.Header().Set("ETag", etag)
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		rw.Header().Set("Last-Modified", lm)
+	}
+
+	// Read one byte past the cap so we can tell "body exactly hit the cap"
+	// apart from "body exceeded the cap": io.LimitReader alone returns a
+	// clean EOF at the cap either way, which would otherwise let a truncated
+	// body get cached and served as if it were complete.
+	body := io.Reader(resp.Body)
+	if *maxInFlightBodyBytes > 0 {
+		body = io.LimitReader(resp.Body, *maxInFlightBodyBytes+1)
+	}
+
+	hasher := sha256.New()
+	toDisk := io.MultiWriter(tmpFile, hasher)
+	tee := io.TeeReader(body, toDisk)
+
+	// clientWriter enforces the same cap on what's actually sent to the
+	// client as body enforces on what's read from upstream, so an overrun
+	// is caught mid-stream rather than only after the full (over-cap) body
+	// has already reached the client.
+	var clientWriter io.Writer = rw
+	if *maxInFlightBodyBytes > 0 {
+		clientWriter = &capWriter{Writer: rw, limit: *maxInFlightBodyBytes}
+	}
+
+	size, copyErr := io.Copy(clientWriter, tee)
+	if copyErr != nil {
+		if errors.Is(copyErr, errBodyCapExceeded) {
+			// Keep draining into the temp file so the upstream body is fully
+			// read off the wire, but the content is discarded either way: it
+			// won't be cached. The caller (streamFetchAndCache) aborts the
+			// client connection once this error comes back out.
+			io.Copy(toDisk, body)
+			tmpFile.Close()
+			logger.Printf("upstream body for %s exceeded -max-inflight-body-bytes (%d); aborting the response, not caching truncated content", requestedPath, *maxInFlightBodyBytes)
+			return "", resp.StatusCode, errBodyCapExceeded
+		}
+		// The client went away mid-stream; keep reading from upstream so the
+		// temp file (and therefore the cache) still gets fully populated.
+		logger.Printf("client disconnected while streaming %s, continuing to fill cache: %v", requestedPath, copyErr)
+		remaining, drainErr := io.Copy(toDisk, body)
+		size += remaining
+		if drainErr != nil {
+			tmpFile.Close()
+			return "", resp.StatusCode, fmt.Errorf("failed to drain body after client disconnect: %w", drainErr)
+		}
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	meta := newCacheMetaFromResponse(resp, size, fmt.Sprintf("%x", hasher.Sum(nil)))
+
+	lock.Lock()
+	if err := saveCacheMeta(cachedFilePath, meta); err != nil {
+		lock.Unlock()
+		return "", resp.StatusCode, err
+	}
+	if err := os.Rename(tmpPath, cachedFilePath); err != nil {
+		lock.Unlock()
+		return "", resp.StatusCode, fmt.Errorf("failed to rename temp file into place: %w", err)
+	}
+	cacheStore.recordWrite(cachedFilePath, size)
+	lock.Unlock()
+
+	return cacheMiss, resp.StatusCode, nil
+}
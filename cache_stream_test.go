@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStreamFetchAndCacheCoalescesConcurrentFetches hammers
+// streamFetchAndCache for the same cachedFilePath from many goroutines at
+// once. It checks both that fetchGroup still collapses the upstream
+// requests into one (chunk0-3) and that exactly one caller ends up as the
+// streaming leader that actually writes the response body (chunk0-7) -
+// every other caller's closure never runs, so its streamed return stays
+// false.
+func TestStreamFetchAndCacheCoalescesConcurrentFetches(t *testing.T) {
+	var hits int32
+	body := strings.Repeat("y", 4096)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	cachedFilePath := filepath.Join(t.TempDir(), "stream-thundering-herd")
+
+	const n = 20
+	var wg sync.WaitGroup
+	var streamedCount int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/stream-thundering-herd", nil)
+			rec := httptest.NewRecorder()
+			rw := &statusCountingWriter{ResponseWriter: rec}
+			_, _, err, streamed := streamFetchAndCache(rw, req, "/stream-thundering-herd", cachedFilePath, srv.URL)
+			if err != nil {
+				t.Errorf("streamFetchAndCache returned error: %v", err)
+				return
+			}
+			if streamed {
+				atomic.AddInt32(&streamedCount, 1)
+				if rec.Body.String() != body {
+					t.Errorf("leader's response body = %d bytes, want %d", rec.Body.Len(), len(body))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected singleflight to collapse %d concurrent fetches into 1 upstream request, got %d", n, got)
+	}
+	if streamedCount != 1 {
+		t.Fatalf("expected exactly 1 of %d callers to be the streaming leader, got %d", n, streamedCount)
+	}
+
+	data, err := os.ReadFile(cachedFilePath)
+	if err != nil {
+		t.Fatalf("cached file not written: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("cached file contents wrong length: got %d want %d", len(data), len(body))
+	}
+}
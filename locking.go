@@ -0,0 +1,36 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// numLockShards controls how many cache paths can be written concurrently
+// without contending on the same mutex. 256 is plenty for a filesystem cache
+// and keeps the shard table small.
+const numLockShards = 256
+
+// stripedLock replaces a single global RWMutex with one mutex per shard,
+// selected by hashing the cache path, so writes to unrelated paths no longer
+// serialize against each other.
+type stripedLock struct {
+	shards [numLockShards]sync.RWMutex
+}
+
+// shardFor returns the mutex responsible for a given cache path. The same
+// path always maps to the same shard, so callers get real mutual exclusion
+// per path while unrelated paths spread across the table.
+func (s *stripedLock) shardFor(cachedFilePath string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(cachedFilePath))
+	return &s.shards[h.Sum32()%numLockShards]
+}
+
+var cacheLocks = &stripedLock{}
+
+// fetchGroup collapses concurrent fetches (whether miss-driven or
+// refresh-driven) for the same cache path into a single upstream request, so
+// a thundering herd of misses doesn't turn into a thundering herd of GETs.
+var fetchGroup singleflight.Group
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"syscall"
 	"time"
 )
 
@@ -23,29 +27,53 @@ const (
 	cacheExpiry = 72 * time.Hour
 	/* How long to wait before checking the remote server for changes. */
 	cacheRefreshTime = 72 * time.Hour
-	accessLogFile    = "access.log"
-	certFile         = "cert.pem" // TLS certificate file
+	accessLogFile    = "access.log" // structured JSON access log, one record per request
+	serverLogFile    = "server.log" // plain diagnostic log (startup, errors, reloads, evictions)
+	certFile         = "cert.pem"   // TLS certificate file
 	keyFile          = "key.key"
 )
 
-var (
-	cacheMutex = sync.RWMutex{} // Protect access to cache metadata
-	logger     *log.Logger
-)
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "how long to wait for in-flight requests to finish during a graceful shutdown")
+
+var logger *log.Logger
 
 func main() {
+	flag.Parse()
+
+	if *acmeEnabled && *acmeHosts == "" {
+		log.Fatalf("-acme-hosts is required when -acme is set")
+	}
+
 	// Ensure cache and logs directories exist
 	createDirIfNotExist(cacheDir)
 	createDirIfNotExist(logsDir)
 
-	// Set up logging
-	logFile, err := os.OpenFile(filepath.Join(logsDir, accessLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	// Set up logging: plain diagnostics to server.log, structured JSON
+	// access records to access.log.
+	logFile, err := os.OpenFile(filepath.Join(logsDir, serverLogFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 	defer logFile.Close()
 	logger = log.New(logFile, "", log.LstdFlags)
 
+	if err := initAccessLogger(); err != nil {
+		log.Fatalf("Failed to open access log file: %v", err)
+	}
+
+	cacheStore = NewCacheStore()
+	if err := cacheStore.rebuildFromDisk(); err != nil {
+		log.Fatalf("Failed to rebuild cache index: %v", err)
+	}
+	go cacheStore.runJanitor()
+	go cacheStore.runHitCountFlusher()
+
+	if err := reloadRoutingConfig(); err != nil {
+		log.Fatalf("Failed to load routes config: %v", err)
+	}
+
+	startAdminServer()
+
 	// Configure HTTPS server
 	server := &http.Server{
 		Addr: ":443",
@@ -57,51 +85,205 @@ func main() {
 
 	fmt.Println("Cache server running...")
 
-	err = server.ListenAndServeTLS(certFile, keyFile)
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if *acmeEnabled {
+			serveErr <- serveWithAutocert(server)
+		} else {
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+		}
+	}()
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case err := <-serveErr:
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+			return
+		case sig := <-sigCh:
+			switch sig {
+			case syscall.SIGHUP:
+				if err := reloadRoutingConfig(); err != nil {
+					logger.Printf("Failed to reload routes config: %v", err)
+				} else {
+					logger.Printf("Reloaded routes config")
+				}
+			case syscall.SIGINT, syscall.SIGTERM:
+				logger.Printf("Shutting down gracefully (draining up to %s)", *drainTimeout)
+				ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+				defer cancel()
+				if err := server.Shutdown(ctx); err != nil {
+					logger.Printf("Graceful shutdown failed: %v", err)
+				}
+				return
+			}
+		}
+	}
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rw := &statusCountingWriter{ResponseWriter: w}
+	var result cacheResult
+	var upstreamStatus int
+	var upstreamLatency time.Duration
+	defer func() {
+		totalLatency := time.Since(start)
+		logAccess(r, rw, result, upstreamStatus, upstreamLatency.Milliseconds(), totalLatency.Milliseconds())
+		metricRequestsTotal.Inc()
+		metricBytesServed.Add(float64(rw.bytes))
+		metricTotalLatency.Observe(totalLatency.Seconds())
+		if upstreamLatency > 0 {
+			metricUpstreamLatency.Observe(upstreamLatency.Seconds())
+		}
+	}()
+
 	requestedPath := r.URL.Path
-	ip := r.RemoteAddr
 
-	cachedFilePath := ""
-	
-	cachedFilePath = filepath.Join(cacheDir, filepath.Clean(requestedPath))
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		metricRequestsRejected.Inc()
+		return
+	}
 
-	logger.Printf("%s incoming request: %s", ip, requestedPath)
+	route, ok := resolveRoute(r)
+	if !ok {
+		http.Error(rw, "No upstream configured for this request", http.StatusNotFound)
+		metricRequestsRejected.Inc()
+		return
+	}
+	cachedFilePath := cachePathFor(route, requestedPath)
 
 	// Check if file exists in cache
-	cacheMutex.RLock()
+	lock := cacheLocks.shardFor(cachedFilePath)
+	lock.RLock()
 	fileInfo, err := os.Stat(cachedFilePath)
-	cacheMutex.RUnlock()
+	var meta *CacheMeta
+	if err == nil {
+		meta, _ = loadCacheMeta(cachedFilePath)
+	}
+
+	if err == nil && meta.isFresh(fileInfo.ModTime()) {
+		// Serve from cache. The read lock has to stay held until the payload
+		// is actually off disk and onto the wire, not just while we stat/load
+		// the metadata - otherwise trim() can unlink this file out from under
+		// ServeFile between the freshness check and the open, turning a valid
+		// hit into a client-visible 404.
+		result = cacheHit
+		metricCacheHits.Inc()
+		cacheStore.recordHit(cachedFilePath)
+		applyResponseCacheHeaders(rw, meta)
+		if r.Method == http.MethodHead {
+			serveHeadFromMeta(rw, meta, fileInfo)
+		} else {
+			http.ServeFile(rw, r, cachedFilePath)
+		}
+		lock.RUnlock()
+		go refreshCacheAsync(requestedPath, cachedFilePath, route.UpstreamBaseURL, fileInfo.ModTime())
+		return
+	}
+	lock.RUnlock()
+
+	// A Range request can't be satisfied against a cache fill that's still in
+	// progress, and we don't stream partial content upstream; make the
+	// client retry rather than serving it a truncated or wrong range.
+	if r.Header.Get("Range") != "" {
+		http.Error(rw, "Range requests are not supported while this entry is being cached; retry shortly", http.StatusServiceUnavailable)
+		return
+	}
+
+	cacheStore.recordMiss()
+	metricCacheMisses.Inc()
+	fetchStart := time.Now()
 
-	if err == nil && time.Since(fileInfo.ModTime()) < cacheExpiry {
-		// Serve from cache
-		logger.Printf("%s serving from cache: %s", ip, requestedPath)
-		http.ServeFile(w, r, cachedFilePath)
-		go refreshCacheAsync(requestedPath, cachedFilePath, fileInfo.ModTime())
+	if r.Method == http.MethodHead {
+		// HEAD never streams a body, so the plain (non-streaming) fetch path
+		// is all it needs.
+		result, upstreamStatus, err = fetchAndCache(requestedPath, cachedFilePath, route.UpstreamBaseURL)
+		upstreamLatency = time.Since(fetchStart)
+		if err != nil {
+			http.Error(rw, "Unable to fetch the requested file", http.StatusInternalServerError)
+			metricUpstreamErrors.Inc()
+			logger.Printf("Failed to fetch file: %s, error: %v", requestedPath, err)
+			return
+		}
+		meta, _ = loadCacheMeta(cachedFilePath)
+		applyResponseCacheHeaders(rw, meta)
+		if fileInfo, err = os.Stat(cachedFilePath); err == nil {
+			serveHeadFromMeta(rw, meta, fileInfo)
+		}
 		return
 	}
 
-	// Fetch from remote server
-	err = fetchAndCache(requestedPath, cachedFilePath)
+	// Stream the upstream response straight to the client while writing it
+	// to the cache in parallel, instead of buffering the whole body on disk
+	// first. Only the request that actually triggers the upstream fetch
+	// streams live; any requests piggybacking on the same in-flight fill
+	// (streamed == false) are served from the now-complete cache file below.
+	var streamed bool
+	result, upstreamStatus, err, streamed = streamFetchAndCache(rw, r, requestedPath, cachedFilePath, route.UpstreamBaseURL)
+	upstreamLatency = time.Since(fetchStart)
 	if err != nil {
-		http.Error(w, "Unable to fetch the requested file", http.StatusInternalServerError)
-		logger.Printf("%s Failed to fetch file: %s, error: %v", ip, requestedPath, err)
+		http.Error(rw, "Unable to fetch the requested file", http.StatusInternalServerError)
+		metricUpstreamErrors.Inc()
+		logger.Printf("Failed to fetch file: %s, error: %v", requestedPath, err)
+		return
+	}
+	if streamed {
 		return
 	}
 
-	// Serve the newly cached file
-	logger.Printf("%s serving newly fetched file: %s", ip, requestedPath)
-	http.ServeFile(w, r, cachedFilePath)
+	// We piggybacked on another caller's in-flight fill rather than streaming
+	// it ourselves, so the payload has to be read back from disk here. Hold
+	// the read lock for the load-and-serve the same way the cache-hit path
+	// above does, so trim() can't unlink it out from under us.
+	lock.RLock()
+	meta, _ = loadCacheMeta(cachedFilePath)
+	applyResponseCacheHeaders(rw, meta)
+	http.ServeFile(rw, r, cachedFilePath)
+	lock.RUnlock()
+}
+
+// serveHeadFromMeta answers a HEAD request from cached metadata alone,
+// without opening the payload file.
+func serveHeadFromMeta(w http.ResponseWriter, meta *CacheMeta, fileInfo os.FileInfo) {
+	size := fileInfo.Size()
+	if meta != nil {
+		size = meta.Size
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.WriteHeader(http.StatusOK)
+}
+
+// fetchOutcome carries doFetchAndCache's classification back through
+// fetchGroup, whose Do only propagates a function's own return values.
+type fetchOutcome struct {
+	result         cacheResult
+	upstreamStatus int
+}
+
+// fetchAndCache fetches requestedPath from upstream and populates
+// cachedFilePath, conditionally against any existing metadata. Concurrent
+// calls for the same cachedFilePath (whether miss-driven or refresh-driven)
+// are collapsed into a single upstream fetch via fetchGroup. It reports how
+// the request was satisfied and what upstream returned, for the access log
+// and metrics.
+func fetchAndCache(requestedPath, cachedFilePath, upstreamBaseURL string) (cacheResult, int, error) {
+	v, err, _ := fetchGroup.Do(cachedFilePath, func() (interface{}, error) {
+		result, upstreamStatus, ferr := doFetchAndCache(requestedPath, cachedFilePath, upstreamBaseURL)
+		return fetchOutcome{result, upstreamStatus}, ferr
+	})
+	outcome := v.(fetchOutcome)
+	return outcome.result, outcome.upstreamStatus, err
 }
 
-func fetchAndCache(requestedPath, cachedFilePath string) error {
-	remoteURL := remoteBaseURL + requestedPath
+func doFetchAndCache(requestedPath, cachedFilePath, upstreamBaseURL string) (cacheResult, int, error) {
+	remoteURL := upstreamBaseURL + requestedPath
 
 	tlsConf, err := skipVerification()
 	if err != nil {
@@ -112,51 +294,100 @@ func fetchAndCache(requestedPath, cachedFilePath string) error {
 		Timeout:   time.Second * 50,
 		Transport: &http.Transport{TLSClientConfig: tlsConf},
 	}
-	resp, err := client.Get(remoteURL)
+
+	req, err := http.NewRequest(http.MethodGet, remoteURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to fetch from remote: %w", err)
+		return "", 0, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	lock := cacheLocks.shardFor(cachedFilePath)
+
+	lock.RLock()
+	existingMeta, _ := loadCacheMeta(cachedFilePath)
+	lock.RUnlock()
+	applyConditionalHeaders(req, existingMeta)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to fetch from remote: %w", err)
 	}
 	defer resp.Body.Close()
 
+	lock.Lock()
+	defer lock.Unlock()
+
+	if resp.StatusCode == http.StatusNotModified {
+		// Not changed upstream: just bump the freshness timestamp, keep the payload.
+		if existingMeta == nil {
+			return "", resp.StatusCode, fmt.Errorf("remote returned 304 but no cached metadata exists for %s", requestedPath)
+		}
+		existingMeta.FetchedAt = time.Now()
+		if err := saveCacheMeta(cachedFilePath, existingMeta); err != nil {
+			return "", resp.StatusCode, err
+		}
+		now := time.Now()
+		if err := os.Chtimes(cachedFilePath, now, now); err != nil {
+			return "", resp.StatusCode, err
+		}
+		cacheStore.recordWrite(cachedFilePath, existingMeta.Size)
+		return cacheRefresh, resp.StatusCode, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("remote server returned non-200 status code: %d", resp.StatusCode)
+		return "", resp.StatusCode, fmt.Errorf("remote server returned non-200 status code: %d", resp.StatusCode)
 	}
 
-	// Write to cache
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
+	dir := filepath.Dir(cachedFilePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to create cache directories: %w", err)
+	}
 
-	err = os.MkdirAll(filepath.Dir(cachedFilePath), os.ModePerm)
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(cachedFilePath)+".tmp-*")
 	if err != nil {
-		return fmt.Errorf("failed to create cache directories: %w", err)
+		return "", resp.StatusCode, fmt.Errorf("failed to create temp file: %w", err)
 	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
 
-	outFile, err := os.Create(cachedFilePath)
+	hasher := sha256.New()
+	size, err := io.Copy(tmpFile, io.TeeReader(resp.Body, hasher))
 	if err != nil {
-		return fmt.Errorf("failed to create cached file: %w", err)
+		tmpFile.Close()
+		return "", resp.StatusCode, fmt.Errorf("failed to write to cached file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to close temp file: %w", err)
 	}
-	defer outFile.Close()
 
-	_, err = io.Copy(outFile, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write to cached file: %w", err)
+	meta := newCacheMetaFromResponse(resp, size, fmt.Sprintf("%x", hasher.Sum(nil)))
+	if err := saveCacheMeta(cachedFilePath, meta); err != nil {
+		return "", resp.StatusCode, err
+	}
+
+	if err := os.Rename(tmpPath, cachedFilePath); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("failed to rename temp file into place: %w", err)
 	}
+	cacheStore.recordWrite(cachedFilePath, size)
 
-	return nil
+	return cacheMiss, resp.StatusCode, nil
 }
 
-func refreshCacheAsync(requestedPath, cachedFilePath string, lastModifiedTime time.Time) {
+func refreshCacheAsync(requestedPath, cachedFilePath, upstreamBaseURL string, lastModifiedTime time.Time) {
 	// Refresh cache only if 24 hours have passed since the last modification
 	if time.Since(lastModifiedTime) < cacheRefreshTime {
 		return
 	}
 
-	logger.Printf("Refreshing cache asynchronously: %s", requestedPath)
-
-	err := fetchAndCache(requestedPath, cachedFilePath)
+	result, upstreamStatus, err := fetchAndCache(requestedPath, cachedFilePath, upstreamBaseURL)
 	if err != nil {
 		logger.Printf("Failed to refresh cache for: %s, error: %v", requestedPath, err)
+		return
 	}
+	accessLogger.Info("background_refresh",
+		"path", requestedPath,
+		"cache_result", string(result),
+		"upstream_status", upstreamStatus,
+	)
 }
 
 func createDirIfNotExist(dir string) {
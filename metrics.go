@@ -0,0 +1,99 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var adminAddr = flag.String("admin-addr", "127.0.0.1:9090", "bind address for the admin listener (/metrics, /debug/vars, /debug/pprof); keep this off the public interface")
+
+var (
+	metricRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_requests_total",
+		Help: "Total number of client requests handled.",
+	})
+	metricRequestsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_requests_rejected_total",
+		Help: "Requests rejected before reaching the cache (bad method, no matching route).",
+	})
+	metricCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_cache_hits_total",
+		Help: "Requests served directly from a fresh cache entry.",
+	})
+	metricCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_cache_misses_total",
+		Help: "Requests that required an upstream fetch.",
+	})
+	metricEvictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_cache_evictions_total",
+		Help: "Cache entries evicted by the janitor to stay under the configured cap.",
+	})
+	metricUpstreamErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_upstream_errors_total",
+		Help: "Upstream fetches that failed or returned a non-2xx/304 status.",
+	})
+	metricBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scs_proxy_bytes_served_total",
+		Help: "Total bytes written to clients.",
+	})
+	metricCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "scs_proxy_cache_bytes",
+		Help: "Current total size of the on-disk cache.",
+	})
+	metricCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "scs_proxy_cache_entries",
+		Help: "Current number of entries in the on-disk cache.",
+	})
+	metricUpstreamLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scs_proxy_upstream_latency_seconds",
+		Help:    "Latency of upstream fetches.",
+		Buckets: prometheus.DefBuckets,
+	})
+	metricTotalLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scs_proxy_request_latency_seconds",
+		Help:    "End-to-end latency of handled requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequestsTotal,
+		metricRequestsRejected,
+		metricCacheHits,
+		metricCacheMisses,
+		metricEvictionsTotal,
+		metricUpstreamErrors,
+		metricBytesServed,
+		metricCacheBytes,
+		metricCacheEntries,
+		metricUpstreamLatency,
+		metricTotalLatency,
+	)
+}
+
+// startAdminServer runs the admin listener (metrics, debug vars, pprof) in
+// the background. It binds to *adminAddr, which defaults to localhost-only
+// so operators don't have to firewall off diagnostics separately.
+func startAdminServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	adminServer := &http.Server{Addr: *adminAddr, Handler: mux}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Printf("Admin listener failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Route maps an incoming request to an upstream origin. A route matches on
+// Host and/or a URL path prefix; at least one of the two should be set, and
+// UpstreamBaseURL is always required.
+type Route struct {
+	Host            string `json:"host,omitempty"`
+	PathPrefix      string `json:"path_prefix,omitempty"`
+	UpstreamBaseURL string `json:"upstream_base_url"`
+}
+
+// RoutingConfig is the on-disk shape of the -routes-config file.
+type RoutingConfig struct {
+	Routes []Route `json:"routes"`
+}
+
+var routesConfigPath = flag.String("routes-config", "", "path to a JSON file mapping Host/path-prefix to upstream base URLs; if unset, every request is routed to the single built-in upstream")
+
+// routingConfig holds the active *RoutingConfig. It's read on every request
+// and swapped wholesale on reload, so readers never see a partially-applied
+// config and a SIGHUP reload never has to touch the listener.
+var routingConfig atomic.Value
+
+// loadRoutingConfig reads and parses the -routes-config file, or returns a
+// single default route covering remoteBaseURL if no config file is set.
+func loadRoutingConfig() (*RoutingConfig, error) {
+	if *routesConfigPath == "" {
+		return &RoutingConfig{Routes: []Route{{UpstreamBaseURL: remoteBaseURL}}}, nil
+	}
+
+	data, err := os.ReadFile(*routesConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes config: %w", err)
+	}
+
+	var cfg RoutingConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse routes config: %w", err)
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, fmt.Errorf("routes config %s defines no routes", *routesConfigPath)
+	}
+	for _, route := range cfg.Routes {
+		if route.UpstreamBaseURL == "" {
+			return nil, fmt.Errorf("routes config %s has a route with no upstream_base_url", *routesConfigPath)
+		}
+	}
+	return &cfg, nil
+}
+
+// reloadRoutingConfig re-reads the routing config and, if it parses cleanly,
+// swaps it in atomically. A bad config on reload is reported but never
+// clobbers the last-known-good config.
+func reloadRoutingConfig() error {
+	cfg, err := loadRoutingConfig()
+	if err != nil {
+		return err
+	}
+	routingConfig.Store(cfg)
+	return nil
+}
+
+func currentRoutingConfig() *RoutingConfig {
+	return routingConfig.Load().(*RoutingConfig)
+}
+
+// resolveRoute finds the best matching route for r: Host must match exactly
+// when the route specifies one, and among matches the longest PathPrefix
+// wins. It returns false if nothing matches.
+func resolveRoute(r *http.Request) (Route, bool) {
+	cfg := currentRoutingConfig()
+
+	var best Route
+	bestLen := -1
+	matched := false
+
+	for _, route := range cfg.Routes {
+		if route.Host != "" && !strings.EqualFold(route.Host, r.Host) {
+			continue
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if len(route.PathPrefix) > bestLen {
+			best, bestLen, matched = route, len(route.PathPrefix), true
+		}
+	}
+	return best, matched
+}
+
+// cachePathFor returns the on-disk cache path for a request matched to
+// route. Host-based routes are namespaced under a per-host subdirectory so
+// two origins serving the same path never collide; path-prefix-only routes
+// already disambiguate via the prefix itself, so the cache layout for a
+// single-upstream deployment is unchanged.
+func cachePathFor(route Route, requestedPath string) string {
+	if route.Host != "" {
+		return filepath.Join(cacheDir, sanitizeForPath(route.Host), filepath.Clean(requestedPath))
+	}
+	return filepath.Join(cacheDir, filepath.Clean(requestedPath))
+}
+
+// sanitizeForPath makes s safe to use as a single path component.
+func sanitizeForPath(s string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(s)
+}